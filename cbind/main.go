@@ -0,0 +1,182 @@
+// Package main is a cgo shim that publishes easyca's CA operations as a
+// C-callable shared library, so non-Go consumers (Python, Node, etc.) can
+// drive the CA without shelling out to a CLI. Build it with
+// `go build -buildmode=c-shared` (see the Makefile) to produce
+// libeasypki.so / libeasypki.dylib plus a generated header.
+//
+// Every *C.char returned by an exported function is heap-allocated with
+// C.CBytes/C.CString; callers must release it with EasyPKI_Free once done.
+package main
+
+/*
+#include <stdlib.h>
+#include <string.h>
+
+// easypki_last_error is thread-local so concurrent callers on separate OS
+// threads each see only their own most recent error, mirroring errno.
+static _Thread_local char *easypki_last_error = NULL;
+
+static void easypki_set_last_error(const char *msg) {
+	if (easypki_last_error != NULL) {
+		free(easypki_last_error);
+		easypki_last_error = NULL;
+	}
+	if (msg != NULL) {
+		easypki_last_error = strdup(msg);
+	}
+}
+
+static char *easypki_get_last_error() {
+	return easypki_last_error;
+}
+*/
+import "C"
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/johncylee/easypki/pkg/easyca"
+)
+
+// defaultValidity is used when a leafRequest omits validDays.
+const defaultValidity = 365 * 24 * time.Hour
+
+// defaultCRLValidity is used for the nextUpdate window of generated CRLs.
+const defaultCRLValidity = 7 * 24 * time.Hour
+
+func setLastError(err error) {
+	if err == nil {
+		C.easypki_set_last_error(nil)
+		return
+	}
+	msg := C.CString(err.Error())
+	defer C.free(unsafe.Pointer(msg))
+	C.easypki_set_last_error(msg)
+}
+
+// EasyPKI_LastError returns the error from the most recent call made on the
+// current OS thread, or an empty string if that call succeeded. The caller
+// must release the returned buffer with EasyPKI_Free.
+//export EasyPKI_LastError
+func EasyPKI_LastError() *C.char {
+	msg := C.easypki_get_last_error()
+	if msg == nil {
+		return C.CString("")
+	}
+	return C.CString(C.GoString(msg))
+}
+
+// EasyPKI_Init lays out a fresh PKI directory structure at pkiroot. It
+// returns 0 on success and -1 on failure; see EasyPKI_LastError for details.
+//export EasyPKI_Init
+func EasyPKI_Init(pkiroot *C.char) C.int {
+	root := C.GoString(pkiroot)
+	if err := easyca.GeneratePKIStructure(root); err != nil {
+		setLastError(fmt.Errorf("init pki: %v", err))
+		return -1
+	}
+	setLastError(nil)
+	return 0
+}
+
+// leafRequest is the JSON shape accepted by EasyPKI_IssueLeaf's cnJSON
+// argument.
+type leafRequest struct {
+	CommonName string   `json:"commonName"`
+	Hosts      []string `json:"hosts"`
+	ValidDays  int      `json:"validDays"`
+	Issuer     string   `json:"issuer"`
+}
+
+// EasyPKI_IssueLeaf issues a leaf certificate named name under pkiroot,
+// signed by issuer (or the root CA, if cnJSON omits one). cnJSON is a JSON
+// object matching leafRequest. On success it returns the leaf's PEM-encoded
+// certificate, with its length written to *outPEMLen; on failure it returns
+// NULL and sets EasyPKI_LastError. The caller must release the returned
+// buffer with EasyPKI_Free.
+//export EasyPKI_IssueLeaf
+func EasyPKI_IssueLeaf(pkiroot, name, cnJSON *C.char, outPEMLen *C.int) *C.char {
+	root := C.GoString(pkiroot)
+	leafName := C.GoString(name)
+
+	var req leafRequest
+	if err := json.Unmarshal([]byte(C.GoString(cnJSON)), &req); err != nil {
+		setLastError(fmt.Errorf("unmarshal leaf request: %v", err))
+		return nil
+	}
+	validity := defaultValidity
+	if req.ValidDays > 0 {
+		validity = time.Duration(req.ValidDays) * 24 * time.Hour
+	}
+
+	subject := pkix.Name{CommonName: req.CommonName}
+	if err := easyca.GenerateLeaf(root, leafName, subject, req.Hosts, validity, req.Issuer); err != nil {
+		setLastError(fmt.Errorf("issue leaf: %v", err))
+		return nil
+	}
+
+	crtPEM, err := ioutil.ReadFile(filepath.Join(root, "issued", leafName+".crt"))
+	if err != nil {
+		setLastError(fmt.Errorf("read issued certificate: %v", err))
+		return nil
+	}
+
+	setLastError(nil)
+	*outPEMLen = C.int(len(crtPEM))
+	return (*C.char)(C.CBytes(crtPEM))
+}
+
+// EasyPKI_Revoke revokes the certificate with the given hex-encoded serial
+// under pkiroot. It returns 0 on success and -1 on failure; see
+// EasyPKI_LastError for details.
+//export EasyPKI_Revoke
+func EasyPKI_Revoke(pkiroot, serialHex *C.char) C.int {
+	root := C.GoString(pkiroot)
+	hex := C.GoString(serialHex)
+
+	serial, ok := new(big.Int).SetString(hex, 16)
+	if !ok {
+		setLastError(fmt.Errorf("invalid serial %q", hex))
+		return -1
+	}
+
+	if err := easyca.RevokeSerial(root, serial); err != nil {
+		setLastError(fmt.Errorf("revoke: %v", err))
+		return -1
+	}
+	setLastError(nil)
+	return 0
+}
+
+// EasyPKI_GenerateCRL generates a fresh CRL for pkiroot. On success it
+// returns the PEM-encoded CRL, with its length written to *outLen; on
+// failure it returns NULL and sets EasyPKI_LastError. The caller must
+// release the returned buffer with EasyPKI_Free.
+//export EasyPKI_GenerateCRL
+func EasyPKI_GenerateCRL(pkiroot *C.char, outLen *C.int) *C.char {
+	root := C.GoString(pkiroot)
+	crlPEM, err := easyca.GenerateCRL(root, defaultCRLValidity)
+	if err != nil {
+		setLastError(fmt.Errorf("generate crl: %v", err))
+		return nil
+	}
+
+	setLastError(nil)
+	*outLen = C.int(len(crlPEM))
+	return (*C.char)(C.CBytes(crlPEM))
+}
+
+// EasyPKI_Free releases a buffer returned by any other EasyPKI_* function.
+//export EasyPKI_Free
+func EasyPKI_Free(buf *C.char) {
+	C.free(unsafe.Pointer(buf))
+}
+
+func main() {}
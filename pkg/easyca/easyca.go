@@ -2,18 +2,27 @@ package easyca
 
 import (
 	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -22,35 +31,198 @@ var (
 	// 0 full string
 	// 1 Valid/Revoked/Expired
 	// 2 Expiration date
-	// 3 Revocation date
+	// 3 Revocation date[,reason]
 	// 4 Serial
 	// 5 Filename
 	// 6 Subject
-	indexRegexp = regexp.MustCompile("^(V|R|E)\t([0-9]{12}Z)\t([0-9]{12}Z)?\t([0-9a-fA-F]{2,})\t([^\t]+)\t(.+)")
+	indexRegexp = regexp.MustCompile("^(V|R|E)\t([0-9]{12}Z)\t([0-9]{12}Z(?:,[A-Za-z]+)?)?\t([0-9a-fA-F]{2,})\t([^\t]+)\t(.+)")
+
+	// oidReasonCode is the CRLReason extension id from RFC 5280 section 5.3.1.
+	oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+)
+
+// RevocationReason is a CRL entry reason code, using the same keywords as
+// openssl's ca index.txt and -crl_reason flag (RFC 5280 section 5.3.1).
+type RevocationReason string
+
+const (
+	ReasonUnspecified          RevocationReason = "unspecified"
+	ReasonKeyCompromise        RevocationReason = "keyCompromise"
+	ReasonCACompromise         RevocationReason = "cACompromise"
+	ReasonAffiliationChanged   RevocationReason = "affiliationChanged"
+	ReasonSuperseded           RevocationReason = "superseded"
+	ReasonCessationOfOperation RevocationReason = "cessationOfOperation"
+	ReasonCertificateHold      RevocationReason = "certificateHold"
+	ReasonRemoveFromCRL        RevocationReason = "removeFromCRL"
+	ReasonPrivilegeWithdrawn   RevocationReason = "privilegeWithdrawn"
+	ReasonAACompromise         RevocationReason = "aACompromise"
 )
 
-func GeneratePrivateKey(path string) (*rsa.PrivateKey, error) {
+// revocationReasonCodes maps the index.txt keywords to the CRLReason
+// enumerated values defined in RFC 5280 section 5.3.1.
+var revocationReasonCodes = map[RevocationReason]int{
+	ReasonUnspecified:          0,
+	ReasonKeyCompromise:        1,
+	ReasonCACompromise:         2,
+	ReasonAffiliationChanged:   3,
+	ReasonSuperseded:           4,
+	ReasonCessationOfOperation: 5,
+	ReasonCertificateHold:      6,
+	ReasonRemoveFromCRL:        8,
+	ReasonPrivilegeWithdrawn:   9,
+	ReasonAACompromise:         10,
+}
+
+// KeySpec selects the key algorithm GeneratePrivateKey and GenerateCertifcate
+// generate. The concrete variants are RSA, ECDSA and Ed25519.
+type KeySpec interface {
+	isKeySpec()
+}
+
+// RSA generates an RSA key pair of the given size. Bits defaults to 2048
+// when zero.
+type RSA struct {
+	Bits int
+}
+
+func (RSA) isKeySpec() {}
+
+// ECDSA generates an ECDSA key pair on the given curve. Curve defaults to
+// elliptic.P256() when nil.
+type ECDSA struct {
+	Curve elliptic.Curve
+}
+
+func (ECDSA) isKeySpec() {}
+
+// Ed25519 generates an Ed25519 key pair.
+type Ed25519 struct{}
+
+func (Ed25519) isKeySpec() {}
+
+// DefaultKeySpec is used by GeneratePrivateKey and GenerateCertifcate when
+// no KeySpec is given, preserving the pre-KeySpec RSA-2048 behavior.
+var DefaultKeySpec KeySpec = RSA{Bits: 2048}
+
+func GeneratePrivateKey(path string, spec KeySpec) (crypto.Signer, error) {
+	if spec == nil {
+		spec = DefaultKeySpec
+	}
+
 	keyFile, err := os.Create(path)
 	if err != nil {
 		return nil, fmt.Errorf("create %v: %v", path, err)
 	}
 	defer keyFile.Close()
 
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("generate private key: %v", err)
+	var pemType string
+	var keyBytes []byte
+	var signer crypto.Signer
+
+	switch s := spec.(type) {
+	case RSA:
+		bits := s.Bits
+		if bits == 0 {
+			bits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, fmt.Errorf("generate rsa private key: %v", err)
+		}
+		pemType = "RSA PRIVATE KEY"
+		keyBytes = x509.MarshalPKCS1PrivateKey(key)
+		signer = key
+	case ECDSA:
+		curve := s.Curve
+		if curve == nil {
+			curve = elliptic.P256()
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate ecdsa private key: %v", err)
+		}
+		keyBytes, err = x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("marshal ecdsa private key: %v", err)
+		}
+		pemType = "EC PRIVATE KEY"
+		signer = key
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate ed25519 private key: %v", err)
+		}
+		keyBytes, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("marshal ed25519 private key: %v", err)
+		}
+		pemType = "PRIVATE KEY"
+		signer = key
+	default:
+		return nil, fmt.Errorf("unsupported key spec %T", spec)
 	}
+
 	err = pem.Encode(keyFile, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+		Type:  pemType,
+		Bytes: keyBytes,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("pem encode private key: %v", err)
 	}
-	return key, nil
+	return signer, nil
+}
+
+// PopulateSANs classifies each host as an IP address, an RFC 5322 email
+// address, an absolute URI, or (failing all of those) a DNS name, and adds
+// it to the matching Subject Alternative Name field on template. Go 1.15+
+// requires a SAN for hostname verification, so it is an error to leave
+// hosts empty when template.Subject.CommonName is also empty.
+func PopulateSANs(template *x509.Certificate, hosts []string) error {
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		if addr, err := mail.ParseAddress(host); err == nil {
+			template.EmailAddresses = append(template.EmailAddresses, addr.Address)
+			continue
+		}
+		if strings.Contains(host, "://") {
+			if u, err := url.ParseRequestURI(host); err == nil && u.IsAbs() {
+				template.URIs = append(template.URIs, u)
+				continue
+			}
+		}
+		template.DNSNames = append(template.DNSNames, host)
+	}
+
+	if template.Subject.CommonName == "" && len(hosts) == 0 {
+		return fmt.Errorf("at least one SAN is required when CommonName is empty")
+	}
+	return nil
 }
 
-func GenerateCertifcate(pkiroot, name string, template *x509.Certificate) error {
+// GenerateLeaf issues a leaf certificate under pkiroot/issued with the given
+// subject and SAN hosts, valid from now for validity. issuer selects the
+// signing CA as in GenerateCertifcate. It is a convenience wrapper around
+// PopulateSANs and GenerateCertifcate for the common case of a TLS
+// server/client certificate.
+func GenerateLeaf(pkiroot, name string, subject pkix.Name, hosts []string, validity time.Duration, issuer string) error {
+	template := &x509.Certificate{
+		Subject:  subject,
+		NotAfter: time.Now().Add(validity),
+	}
+	if err := PopulateSANs(template, hosts); err != nil {
+		return fmt.Errorf("populate sans: %v", err)
+	}
+	return GenerateCertifcate(pkiroot, name, template, nil, issuer)
+}
+
+// GenerateCertifcate issues the root CA (name "ca", template.IsCA true,
+// self-signed) or a leaf certificate under pkiroot/issued. issuer picks the
+// signing CA for leaf certificates: "" or "ca" for the root, or the name of
+// a sub-CA created with GenerateIntermediate.
+func GenerateCertifcate(pkiroot, name string, template *x509.Certificate, spec KeySpec, issuer string) error {
 	// TODO(jclerc): check that pki has been init
 
 	var crtPath string
@@ -62,18 +234,18 @@ func GenerateCertifcate(pkiroot, name string, template *x509.Certificate) error
 	}
 
 	var caCrt *x509.Certificate
-	var caKey *rsa.PrivateKey
+	var caKey crypto.Signer
 
 	if _, err := os.Stat(privateKeyPath); err == nil {
 		return fmt.Errorf("a key pair for %v already exists", name)
 	}
 
-	privateKey, err := GeneratePrivateKey(privateKeyPath)
+	privateKey, err := GeneratePrivateKey(privateKeyPath, spec)
 	if err != nil {
 		return fmt.Errorf("generate private key: %v", err)
 	}
 
-	publicKeyBytes, err := asn1.Marshal(*privateKey.Public().(*rsa.PublicKey))
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
 	if err != nil {
 		return fmt.Errorf("marshal public key: %v", err)
 	}
@@ -81,7 +253,8 @@ func GenerateCertifcate(pkiroot, name string, template *x509.Certificate) error
 	template.SubjectKeyId = subjectKeyId[:]
 
 	template.NotBefore = time.Now()
-	template.SignatureAlgorithm = x509.SHA256WithRSA
+	// SignatureAlgorithm is left as the zero value so x509.CreateCertificate
+	// picks the algorithm that matches caKey's type.
 	if template.IsCA {
 		serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 		serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -104,9 +277,9 @@ func GenerateCertifcate(pkiroot, name string, template *x509.Certificate) error
 		}
 		template.SerialNumber = serialNumber
 
-		caCrt, caKey, err = GetCA(pkiroot)
+		caCrt, caKey, err = GetSigner(pkiroot, issuer)
 		if err != nil {
-			return fmt.Errorf("get ca: %v", err)
+			return fmt.Errorf("get signer: %v", err)
 		}
 	}
 
@@ -131,15 +304,133 @@ func GenerateCertifcate(pkiroot, name string, template *x509.Certificate) error
 
 	// I do not think we have to write the ca.crt in the index
 	if !template.IsCA {
-		WriteIndex(pkiroot, name, template)
-		if err != nil {
+		if err := WriteIndex(pkiroot, name, template); err != nil {
 			return fmt.Errorf("write index: %v", err)
 		}
+		if err := writeChain(pkiroot, name, crt, issuer); err != nil {
+			return fmt.Errorf("write chain: %v", err)
+		}
 	}
 	return nil
 }
 
-func GetCA(pkiroot string) (*x509.Certificate, *rsa.PrivateKey, error) {
+// GenerateIntermediate issues a sub-CA certificate under pkiroot/intermediate,
+// signed by the root CA, and records it in pkiroot/intermediate/index.txt.
+// Leaf certificates can then be issued under it by passing name as the
+// issuer to GenerateCertifcate or GenerateLeaf.
+func GenerateIntermediate(pkiroot, name string, template *x509.Certificate) error {
+	privateKeyPath := filepath.Join(pkiroot, "private", name+".key")
+	crtPath := filepath.Join(pkiroot, "intermediate", name+".crt")
+
+	if _, err := os.Stat(privateKeyPath); err == nil {
+		return fmt.Errorf("a key pair for %v already exists", name)
+	}
+
+	caCrt, caKey, err := GetCA(pkiroot)
+	if err != nil {
+		return fmt.Errorf("get ca: %v", err)
+	}
+
+	privateKey, err := GeneratePrivateKey(privateKeyPath, nil)
+	if err != nil {
+		return fmt.Errorf("generate private key: %v", err)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return fmt.Errorf("marshal public key: %v", err)
+	}
+	subjectKeyId := sha1.Sum(publicKeyBytes)
+	template.SubjectKeyId = subjectKeyId[:]
+
+	template.NotBefore = time.Now()
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.MaxPathLen = 0
+	template.MaxPathLenZero = true
+
+	serialNumber, err := NextSerial(pkiroot)
+	if err != nil {
+		return fmt.Errorf("get next serial: %v", err)
+	}
+	template.SerialNumber = serialNumber
+
+	crt, err := x509.CreateCertificate(rand.Reader, template, caCrt, privateKey.Public(), caKey)
+	if err != nil {
+		return fmt.Errorf("create certificate: %v", err)
+	}
+
+	crtFile, err := os.Create(crtPath)
+	if err != nil {
+		return fmt.Errorf("create %v: %v", crtPath, err)
+	}
+	defer crtFile.Close()
+
+	if err := pem.Encode(crtFile, &pem.Block{Type: "CERTIFICATE", Bytes: crt}); err != nil {
+		return fmt.Errorf("pem encode crt: %v", err)
+	}
+
+	return writeIntermediateIndex(pkiroot, name, template)
+}
+
+// GetSigner loads the certificate and private key to sign with: the root CA
+// when caName is "" or "ca", or the sub-CA caName issued with
+// GenerateIntermediate.
+func GetSigner(pkiroot, caName string) (*x509.Certificate, crypto.Signer, error) {
+	if caName == "" || caName == "ca" {
+		return GetCA(pkiroot)
+	}
+
+	keyBytes, err := ioutil.ReadFile(filepath.Join(pkiroot, "private", caName+".key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %v private key: %v", caName, err)
+	}
+	p, _ := pem.Decode(keyBytes)
+	if p == nil {
+		return nil, nil, fmt.Errorf("pem decode did not found pem encoded %v private key", caName)
+	}
+	caKey, err := parsePrivateKey(p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse %v private key: %v", caName, err)
+	}
+
+	caCrt, err := GetCertificate(filepath.Join(pkiroot, "intermediate", caName+".crt"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("get %v certificate: %v", caName, err)
+	}
+
+	return caCrt, caKey, nil
+}
+
+// writeChain writes pkiroot/issued/<name>-chain.pem with the newly issued
+// leaf certificate followed by its issuing chain, up to but not including
+// the root CA.
+func writeChain(pkiroot, name string, leafDER []byte, issuer string) error {
+	chainPath := filepath.Join(pkiroot, "issued", name+"-chain.pem")
+	f, err := os.Create(chainPath)
+	if err != nil {
+		return fmt.Errorf("create %v: %v", chainPath, err)
+	}
+	defer f.Close()
+
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER}); err != nil {
+		return fmt.Errorf("pem encode leaf: %v", err)
+	}
+
+	if issuer != "" && issuer != "ca" {
+		issuerCrt, err := GetCertificate(filepath.Join(pkiroot, "intermediate", issuer+".crt"))
+		if err != nil {
+			return fmt.Errorf("get issuer %v certificate: %v", issuer, err)
+		}
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: issuerCrt.Raw}); err != nil {
+			return fmt.Errorf("pem encode issuer: %v", err)
+		}
+	}
+	return nil
+}
+
+func GetCA(pkiroot string) (*x509.Certificate, crypto.Signer, error) {
 	caKeyBytes, err := ioutil.ReadFile(filepath.Join(pkiroot, "private", "ca.key"))
 	if err != nil {
 		return nil, nil, fmt.Errorf("read ca private key: %v", err)
@@ -148,7 +439,7 @@ func GetCA(pkiroot string) (*x509.Certificate, *rsa.PrivateKey, error) {
 	if p == nil {
 		return nil, nil, fmt.Errorf("pem decode did not found pem encoded ca private key")
 	}
-	caKey, err := x509.ParsePKCS1PrivateKey(p.Bytes)
+	caKey, err := parsePrivateKey(p)
 	if err != nil {
 		return nil, nil, fmt.Errorf("parse ca private key: %v", err)
 	}
@@ -169,30 +460,77 @@ func GetCA(pkiroot string) (*x509.Certificate, *rsa.PrivateKey, error) {
 	return caCrt, caKey, nil
 }
 
+// parsePrivateKey dispatches a decoded private key PEM block to the parser
+// matching its type, as produced by GeneratePrivateKey.
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("pkcs8 key of type %T is not a crypto.Signer", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key pem type %q", block.Type)
+	}
+}
+
 func RevokeSerial(pkiroot string, serial *big.Int) error {
-	f, err := os.OpenFile(filepath.Join(pkiroot, "index.txt"), os.O_RDWR, 0644)
+	return RevokeSerialWithReason(pkiroot, serial, ReasonUnspecified)
+}
+
+// RevokeSerialWithReason behaves like RevokeSerial but also records the
+// given RFC 5280 revocation reason in index.txt, so that GenerateCRL can
+// later emit it as a CRLReason entry extension.
+//
+// index.txt is rewritten to a temp file and renamed into place atomically,
+// under pkiLock, so a crash mid-write or a concurrent writer cannot leave
+// index.txt truncated or corrupted.
+func RevokeSerialWithReason(pkiroot string, serial *big.Int, reason RevocationReason) error {
+	if _, ok := revocationReasonCodes[reason]; !ok {
+		return fmt.Errorf("unknown revocation reason %q", reason)
+	}
+
+	unlock, err := pkiLock(pkiroot)
+	if err != nil {
+		return fmt.Errorf("lock pki: %v", err)
+	}
+	defer unlock()
+
+	indexPath := filepath.Join(pkiroot, "index.txt")
+	f, err := os.Open(indexPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	var lines []string
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		matches := indexRegexp.FindStringSubmatch(scanner.Text())
 		if len(matches) != 7 {
+			f.Close()
 			return fmt.Errorf("wrong line format")
 		}
 		matchedSerial := big.NewInt(0)
 		fmt.Sscanf(matches[4], "%X", matchedSerial)
 		if matchedSerial.Cmp(serial) == 0 {
 			if matches[1] == "R" {
+				f.Close()
 				return fmt.Errorf("certificate already revoked")
 			}
 
-			lines = append(lines, fmt.Sprintf("R\t%v\t%vZ\t%v\t%v\t%v",
+			lines = append(lines, fmt.Sprintf("R\t%v\t%vZ,%v\t%v\t%v\t%v",
 				matches[2],
 				time.Now().UTC().Format("060102150405"),
+				reason,
 				matches[4],
 				matches[5],
 				matches[6]))
@@ -200,19 +538,215 @@ func RevokeSerial(pkiroot string, serial *big.Int) error {
 			lines = append(lines, matches[0])
 		}
 	}
+	scanErr := scanner.Err()
+	f.Close()
+	if scanErr != nil {
+		return scanErr
+	}
 
-	f.Truncate(0)
-	f.Seek(0, 0)
+	tmp, err := ioutil.TempFile(pkiroot, "index.txt.tmp-")
+	if err != nil {
+		return fmt.Errorf("create temp index: %v", err)
+	}
+	tmpPath := tmp.Name()
 
 	for _, line := range lines {
-		n, err := fmt.Fprintln(f, line)
+		n, err := fmt.Fprintln(tmp, line)
 		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
 			return fmt.Errorf("write line: %v", err)
 		}
 		if n == 0 {
+			tmp.Close()
+			os.Remove(tmpPath)
 			return fmt.Errorf("supposed to write [%v], written 0 bytes", line)
 		}
 	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("close temp index: %v", err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("chmod temp index: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename temp index: %v", err)
+	}
+	return nil
+}
+
+// revokedIndexEntries returns the pkix.RevokedCertificate entries for every
+// index.txt line marked "R", ready to embed in a CRL TBSCertList.
+func revokedIndexEntries(pkiroot string) ([]pkix.RevokedCertificate, error) {
+	f, err := os.Open(filepath.Join(pkiroot, "index.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var revoked []pkix.RevokedCertificate
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		matches := indexRegexp.FindStringSubmatch(scanner.Text())
+		if len(matches) != 7 {
+			return nil, fmt.Errorf("wrong line format")
+		}
+		if matches[1] != "R" {
+			continue
+		}
+
+		serial := big.NewInt(0)
+		fmt.Sscanf(matches[4], "%X", serial)
+
+		revokedAt, reason, err := parseIndexRevocation(matches[3])
+		if err != nil {
+			return nil, fmt.Errorf("parse revocation entry for serial %v: %v", matches[4], err)
+		}
+
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: revokedAt,
+		}
+		if reason != ReasonUnspecified {
+			reasonExt, err := reasonExtension(reason)
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{reasonExt}
+		}
+		revoked = append(revoked, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// parseIndexRevocation splits an index.txt revocation field ("date" or
+// "date,reason") into its timestamp and reason parts.
+func parseIndexRevocation(field string) (time.Time, RevocationReason, error) {
+	parts := strings.SplitN(field, ",", 2)
+	revokedAt, err := time.Parse("060102150405Z", parts[0])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("parse revocation date: %v", err)
+	}
+	if len(parts) == 2 {
+		return revokedAt, RevocationReason(parts[1]), nil
+	}
+	return revokedAt, ReasonUnspecified, nil
+}
+
+// reasonExtension encodes a RevocationReason as the CRLReason entry
+// extension described in RFC 5280 section 5.3.1.
+func reasonExtension(reason RevocationReason) (pkix.Extension, error) {
+	code, ok := revocationReasonCodes[reason]
+	if !ok {
+		return pkix.Extension{}, fmt.Errorf("unknown revocation reason %q", reason)
+	}
+	value, err := asn1.Marshal(asn1.Enumerated(code))
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("marshal revocation reason: %v", err)
+	}
+	return pkix.Extension{Id: oidReasonCode, Value: value}, nil
+}
+
+// nextCounter reads a hex counter file such as pkiroot/serial or
+// pkiroot/crlnumber, returns its current value, and persists it incremented
+// by one. It holds pkiLock for the whole read-increment-write so concurrent
+// callers never observe or persist the same value.
+func nextCounter(pkiroot, path string) (*big.Int, error) {
+	unlock, err := pkiLock(pkiroot)
+	if err != nil {
+		return nil, fmt.Errorf("lock pki: %v", err)
+	}
+	defer unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %v: %v", path, err)
+	}
+
+	current := new(big.Int)
+	if _, ok := current.SetString(strings.TrimSpace(string(data)), 16); !ok {
+		return nil, fmt.Errorf("parse %v: invalid value %q", path, data)
+	}
+
+	next := new(big.Int).Add(current, big.NewInt(1))
+	nextHex := fmt.Sprintf("%X", next)
+	if len(nextHex)%2 == 1 {
+		nextHex = "0" + nextHex
+	}
+	if err := ioutil.WriteFile(path, []byte(nextHex+"\n"), 0644); err != nil {
+		return nil, fmt.Errorf("write %v: %v", path, err)
+	}
+	return current, nil
+}
+
+// NextSerial reads pkiroot/serial, returns its current value for use as a
+// certificate's serial number, and persists the incremented counter.
+func NextSerial(pkiroot string) (*big.Int, error) {
+	return nextCounter(pkiroot, filepath.Join(pkiroot, "serial"))
+}
+
+// nextCRLNumber reads pkiroot/crlnumber, returns its current value for use
+// as the CRL Number extension, and persists the incremented counter.
+func nextCRLNumber(pkiroot string) (*big.Int, error) {
+	return nextCounter(pkiroot, filepath.Join(pkiroot, "crlnumber"))
+}
+
+// GenerateCRL walks index.txt and produces a signed X.509 v2 CRL listing
+// every revoked certificate, valid from now until now+nextUpdate.
+func GenerateCRL(pkiroot string, nextUpdate time.Duration) ([]byte, error) {
+	caCrt, caKey, err := GetCA(pkiroot)
+	if err != nil {
+		return nil, fmt.Errorf("get ca: %v", err)
+	}
+
+	revoked, err := revokedIndexEntries(pkiroot)
+	if err != nil {
+		return nil, fmt.Errorf("collect revoked certificates: %v", err)
+	}
+
+	crlNumber, err := nextCRLNumber(pkiroot)
+	if err != nil {
+		return nil, fmt.Errorf("next crl number: %v", err)
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:              crlNumber,
+		RevokedCertificates: revoked,
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(nextUpdate),
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, template, caCrt, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("create crl: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "X509 CRL",
+		Bytes: crl,
+	}), nil
+}
+
+// WriteCRL generates a CRL like GenerateCRL and persists it to
+// pkiroot/crl.pem.
+func WriteCRL(pkiroot string, nextUpdate time.Duration) error {
+	crlPEM, err := GenerateCRL(pkiroot, nextUpdate)
+	if err != nil {
+		return err
+	}
+
+	crlPath := filepath.Join(pkiroot, "crl.pem")
+	if err := ioutil.WriteFile(crlPath, crlPEM, 0644); err != nil {
+		return fmt.Errorf("write %v: %v", crlPath, err)
+	}
 	return nil
 }
 
@@ -234,7 +768,25 @@ func GetCertificate(path string) (*x509.Certificate, error) {
 }
 
 func WriteIndex(pkiroot, filename string, crt *x509.Certificate) error {
-	f, err := os.OpenFile(filepath.Join(pkiroot, "index.txt"), os.O_WRONLY|os.O_APPEND, 0644)
+	return writeIndexEntry(pkiroot, filepath.Join(pkiroot, "index.txt"), filename, crt)
+}
+
+// writeIntermediateIndex records an issued sub-CA certificate in
+// pkiroot/intermediate/index.txt, mirroring WriteIndex's format.
+func writeIntermediateIndex(pkiroot, filename string, crt *x509.Certificate) error {
+	return writeIndexEntry(pkiroot, filepath.Join(pkiroot, "intermediate", "index.txt"), filename, crt)
+}
+
+// writeIndexEntry appends filename's entry to indexPath under pkiLock, so
+// concurrent issuances cannot interleave their writes.
+func writeIndexEntry(pkiroot, indexPath, filename string, crt *x509.Certificate) error {
+	unlock, err := pkiLock(pkiroot)
+	if err != nil {
+		return fmt.Errorf("lock pki: %v", err)
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
@@ -263,18 +815,23 @@ func WriteIndex(pkiroot, filename string, crt *x509.Certificate) error {
 }
 
 // |-ca.crt
+// |-crl.pem
 // |-crlnumber
 // |-index.txt
 // |-index.txt.attr
 // |-serial
 // |-issued/
 //   |- name.crt
+//   |- name-chain.pem
+// |-intermediate/
+//   |- index.txt
+//   |- name.crt
 // |-private
 //   |- ca.key
 //   |- name.key
 func GeneratePKIStructure(pkiroot string) error {
 
-	for _, dir := range []string{"private", "issued"} {
+	for _, dir := range []string{"private", "issued", "intermediate"} {
 		err := os.Mkdir(filepath.Join(pkiroot, dir), 0755)
 		if err != nil {
 			return fmt.Errorf("creating dir %v: %v", dir, err)
@@ -313,6 +870,12 @@ func GeneratePKIStructure(pkiroot string) error {
 	}
 	defer index.Close()
 
+	intermediateIndex, err := os.Create(filepath.Join(pkiroot, "intermediate", "index.txt"))
+	if err != nil {
+		return fmt.Errorf("create intermediate index: %v", err)
+	}
+	defer intermediateIndex.Close()
+
 	indexattr, err := os.Create(filepath.Join(pkiroot, "index.txt.attr"))
 	if err != nil {
 		return fmt.Errorf("create index.txt.attr: %v", err)
@@ -0,0 +1,412 @@
+package easyca
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGenerateCRL(t *testing.T) {
+	pkiroot, err := ioutil.TempDir("", "easyca-crl")
+	if err != nil {
+		t.Fatalf("create tmp pkiroot: %v", err)
+	}
+	defer os.RemoveAll(pkiroot)
+
+	if err := GeneratePKIStructure(pkiroot); err != nil {
+		t.Fatalf("generate pki structure: %v", err)
+	}
+
+	err = GenerateCertifcate(pkiroot, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+
+	err = GenerateCertifcate(pkiroot, "leaf", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "leaf.test"},
+		NotAfter: time.Now().Add(365 * 24 * time.Hour),
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("generate leaf: %v", err)
+	}
+
+	leafCrt, err := GetCertificate(pkiroot + "/issued/leaf.crt")
+	if err != nil {
+		t.Fatalf("read leaf crt: %v", err)
+	}
+
+	if err := RevokeSerialWithReason(pkiroot, leafCrt.SerialNumber, ReasonKeyCompromise); err != nil {
+		t.Fatalf("revoke leaf: %v", err)
+	}
+
+	crlPEM, err := GenerateCRL(pkiroot, time.Hour)
+	if err != nil {
+		t.Fatalf("generate crl: %v", err)
+	}
+
+	block, _ := pem.Decode(crlPEM)
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("expected a PEM encoded X509 CRL, got %v", block)
+	}
+
+	crl, err := x509.ParseCRL(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse crl: %v", err)
+	}
+
+	caCrt, _, err := GetCA(pkiroot)
+	if err != nil {
+		t.Fatalf("get ca: %v", err)
+	}
+	if err := caCrt.CheckCRLSignature(crl); err != nil {
+		t.Fatalf("check crl signature: %v", err)
+	}
+
+	if len(crl.TBSCertList.RevokedCertificates) != 1 {
+		t.Fatalf("expected 1 revoked certificate, got %v", len(crl.TBSCertList.RevokedCertificates))
+	}
+	revoked := crl.TBSCertList.RevokedCertificates[0]
+	if revoked.SerialNumber.Cmp(leafCrt.SerialNumber) != 0 {
+		t.Fatalf("expected revoked serial %v, got %v", leafCrt.SerialNumber, revoked.SerialNumber)
+	}
+
+	gotCRLNumber, err := ioutil.ReadFile(pkiroot + "/crlnumber")
+	if err != nil {
+		t.Fatalf("read crlnumber: %v", err)
+	}
+	if string(gotCRLNumber) != "02\n" {
+		t.Fatalf("expected crlnumber to be incremented to 02, got %q", gotCRLNumber)
+	}
+}
+
+func TestPopulateSANs(t *testing.T) {
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: "san.test"}}
+	hosts := []string{"example.com", "192.0.2.1", "admin@example.com", "spiffe://example.com/sa"}
+
+	if err := PopulateSANs(template, hosts); err != nil {
+		t.Fatalf("populate sans: %v", err)
+	}
+
+	if len(template.DNSNames) != 1 || template.DNSNames[0] != "example.com" {
+		t.Fatalf("expected DNSNames [example.com], got %v", template.DNSNames)
+	}
+	if len(template.IPAddresses) != 1 || template.IPAddresses[0].String() != "192.0.2.1" {
+		t.Fatalf("expected IPAddresses [192.0.2.1], got %v", template.IPAddresses)
+	}
+	if len(template.EmailAddresses) != 1 || template.EmailAddresses[0] != "admin@example.com" {
+		t.Fatalf("expected EmailAddresses [admin@example.com], got %v", template.EmailAddresses)
+	}
+	if len(template.URIs) != 1 || template.URIs[0].String() != "spiffe://example.com/sa" {
+		t.Fatalf("expected URIs [spiffe://example.com/sa], got %v", template.URIs)
+	}
+}
+
+func TestPopulateSANsHostWithPortIsNotMistakenForURI(t *testing.T) {
+	template := &x509.Certificate{Subject: pkix.Name{CommonName: "san.test"}}
+	hosts := []string{"localhost:8080"}
+
+	if err := PopulateSANs(template, hosts); err != nil {
+		t.Fatalf("populate sans: %v", err)
+	}
+
+	if len(template.URIs) != 0 {
+		t.Fatalf("expected no URIs, got %v", template.URIs)
+	}
+	if len(template.DNSNames) != 1 || template.DNSNames[0] != "localhost:8080" {
+		t.Fatalf("expected DNSNames [localhost:8080], got %v", template.DNSNames)
+	}
+}
+
+func TestPopulateSANsRequiresSANWithoutCommonName(t *testing.T) {
+	template := &x509.Certificate{}
+	if err := PopulateSANs(template, nil); err == nil {
+		t.Fatal("expected an error for empty CommonName and no SANs")
+	}
+}
+
+func TestGenerateLeaf(t *testing.T) {
+	pkiroot, err := ioutil.TempDir("", "easyca-leaf")
+	if err != nil {
+		t.Fatalf("create tmp pkiroot: %v", err)
+	}
+	defer os.RemoveAll(pkiroot)
+
+	if err := GeneratePKIStructure(pkiroot); err != nil {
+		t.Fatalf("generate pki structure: %v", err)
+	}
+
+	err = GenerateCertifcate(pkiroot, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+
+	err = GenerateLeaf(pkiroot, "www", pkix.Name{CommonName: "www.test"}, []string{"www.test", "127.0.0.1"}, 365*24*time.Hour, "")
+	if err != nil {
+		t.Fatalf("generate leaf: %v", err)
+	}
+
+	leafCrt, err := GetCertificate(pkiroot + "/issued/www.crt")
+	if err != nil {
+		t.Fatalf("read leaf crt: %v", err)
+	}
+	if len(leafCrt.DNSNames) != 1 || leafCrt.DNSNames[0] != "www.test" {
+		t.Fatalf("expected DNSNames [www.test], got %v", leafCrt.DNSNames)
+	}
+	if len(leafCrt.IPAddresses) != 1 || leafCrt.IPAddresses[0].String() != "127.0.0.1" {
+		t.Fatalf("expected IPAddresses [127.0.0.1], got %v", leafCrt.IPAddresses)
+	}
+}
+
+func TestGenerateIntermediate(t *testing.T) {
+	pkiroot, err := ioutil.TempDir("", "easyca-intermediate")
+	if err != nil {
+		t.Fatalf("create tmp pkiroot: %v", err)
+	}
+	defer os.RemoveAll(pkiroot)
+
+	if err := GeneratePKIStructure(pkiroot); err != nil {
+		t.Fatalf("generate pki structure: %v", err)
+	}
+
+	err = GenerateCertifcate(pkiroot, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "root ca"},
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+
+	err = GenerateIntermediate(pkiroot, "sub-ca", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "sub ca"},
+		NotAfter: time.Now().Add(5 * 365 * 24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("generate intermediate: %v", err)
+	}
+
+	subCACrt, err := GetCertificate(pkiroot + "/intermediate/sub-ca.crt")
+	if err != nil {
+		t.Fatalf("read sub ca crt: %v", err)
+	}
+	if !subCACrt.IsCA {
+		t.Fatal("expected sub ca certificate to have IsCA set")
+	}
+	if subCACrt.KeyUsage != x509.KeyUsageCertSign|x509.KeyUsageCRLSign {
+		t.Fatalf("expected KeyUsage CertSign|CRLSign, got %v", subCACrt.KeyUsage)
+	}
+	if !subCACrt.MaxPathLenZero || subCACrt.MaxPathLen != 0 {
+		t.Fatalf("expected MaxPathLen 0 (MaxPathLenZero), got MaxPathLen=%v MaxPathLenZero=%v", subCACrt.MaxPathLen, subCACrt.MaxPathLenZero)
+	}
+
+	rootCrt, _, err := GetCA(pkiroot)
+	if err != nil {
+		t.Fatalf("get ca: %v", err)
+	}
+	if err := subCACrt.CheckSignatureFrom(rootCrt); err != nil {
+		t.Fatalf("sub ca certificate was not signed by root: %v", err)
+	}
+
+	err = GenerateCertifcate(pkiroot, "leaf", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "leaf.test"},
+		NotAfter: time.Now().Add(365 * 24 * time.Hour),
+	}, nil, "sub-ca")
+	if err != nil {
+		t.Fatalf("generate leaf under intermediate: %v", err)
+	}
+
+	leafCrt, err := GetCertificate(pkiroot + "/issued/leaf.crt")
+	if err != nil {
+		t.Fatalf("read leaf crt: %v", err)
+	}
+	if err := leafCrt.CheckSignatureFrom(subCACrt); err != nil {
+		t.Fatalf("leaf certificate was not signed by the intermediate: %v", err)
+	}
+
+	chainPEM, err := ioutil.ReadFile(pkiroot + "/issued/leaf-chain.pem")
+	if err != nil {
+		t.Fatalf("read chain: %v", err)
+	}
+	var chain []*x509.Certificate
+	rest := chainPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("parse chain certificate: %v", err)
+		}
+		chain = append(chain, crt)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("expected leaf+intermediate in the chain, got %v certificates", len(chain))
+	}
+	if chain[0].SerialNumber.Cmp(leafCrt.SerialNumber) != 0 {
+		t.Fatalf("expected the leaf certificate first in the chain, got %v", chain[0].Subject)
+	}
+	if chain[1].SerialNumber.Cmp(subCACrt.SerialNumber) != 0 {
+		t.Fatalf("expected the intermediate certificate second in the chain, got %v", chain[1].Subject)
+	}
+}
+
+func TestGeneratePrivateKeySpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "easyca-keyspec")
+	if err != nil {
+		t.Fatalf("create tmp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name    string
+		spec    KeySpec
+		pemType string
+		check   func(t *testing.T, signer interface{})
+	}{
+		{"rsa", RSA{Bits: 2048}, "RSA PRIVATE KEY", func(t *testing.T, signer interface{}) {
+			if _, ok := signer.(*rsa.PrivateKey); !ok {
+				t.Fatalf("expected *rsa.PrivateKey, got %T", signer)
+			}
+		}},
+		{"ecdsa", ECDSA{Curve: elliptic.P256()}, "EC PRIVATE KEY", func(t *testing.T, signer interface{}) {
+			if _, ok := signer.(*ecdsa.PrivateKey); !ok {
+				t.Fatalf("expected *ecdsa.PrivateKey, got %T", signer)
+			}
+		}},
+		{"ed25519", Ed25519{}, "PRIVATE KEY", func(t *testing.T, signer interface{}) {
+			if _, ok := signer.(ed25519.PrivateKey); !ok {
+				t.Fatalf("expected ed25519.PrivateKey, got %T", signer)
+			}
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name+".key")
+			signer, err := GeneratePrivateKey(path, c.spec)
+			if err != nil {
+				t.Fatalf("generate private key: %v", err)
+			}
+			c.check(t, signer)
+
+			keyBytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read key file: %v", err)
+			}
+			block, _ := pem.Decode(keyBytes)
+			if block == nil || block.Type != c.pemType {
+				t.Fatalf("expected pem type %v, got %v", c.pemType, block)
+			}
+		})
+	}
+}
+
+func TestGenerateCertifcateConcurrentSerials(t *testing.T) {
+	pkiroot, err := ioutil.TempDir("", "easyca-concurrent")
+	if err != nil {
+		t.Fatalf("create tmp pkiroot: %v", err)
+	}
+	defer os.RemoveAll(pkiroot)
+
+	if err := GeneratePKIStructure(pkiroot); err != nil {
+		t.Fatalf("generate pki structure: %v", err)
+	}
+
+	err = GenerateCertifcate(pkiroot, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, "")
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+
+	const concurrency = 32
+	errs := make([]error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = GenerateCertifcate(pkiroot, fmt.Sprintf("leaf-%d", i), &x509.Certificate{
+				Subject:  pkix.Name{CommonName: fmt.Sprintf("leaf-%d.test", i)},
+				NotAfter: time.Now().Add(365 * 24 * time.Hour),
+			}, nil, "")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("generate leaf-%d: %v", i, err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(pkiroot, "index.txt"))
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	lineCount := 0
+	for scanner.Scan() {
+		lineCount++
+		matches := indexRegexp.FindStringSubmatch(scanner.Text())
+		if len(matches) != 7 {
+			t.Fatalf("malformed index.txt line: %q", scanner.Text())
+		}
+		if seen[matches[4]] {
+			t.Fatalf("duplicate serial %v in index.txt", matches[4])
+		}
+		seen[matches[4]] = true
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("scan index: %v", err)
+	}
+	if lineCount != concurrency {
+		t.Fatalf("expected %v index.txt lines, got %v", concurrency, lineCount)
+	}
+
+	serial, err := ioutil.ReadFile(filepath.Join(pkiroot, "serial"))
+	if err != nil {
+		t.Fatalf("read serial: %v", err)
+	}
+	want := new(big.Int).Add(big.NewInt(1), big.NewInt(concurrency))
+	got := new(big.Int)
+	if _, ok := got.SetString(strings.TrimSpace(string(serial)), 16); !ok {
+		t.Fatalf("parse serial counter %q", serial)
+	}
+	if got.Cmp(want) != 0 {
+		t.Fatalf("expected serial counter %v, got %v", want, got)
+	}
+}
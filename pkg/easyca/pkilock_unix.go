@@ -0,0 +1,32 @@
+//go:build !windows
+
+package easyca
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// pkiLock acquires an exclusive advisory lock on pkiroot/.lock, so that
+// concurrent goroutines or processes issuing/revoking certificates against
+// the same pkiroot serialize on the serial, crlnumber and index.txt files.
+// Call the returned unlock func to release it.
+func pkiLock(pkiroot string) (unlock func(), err error) {
+	path := filepath.Join(pkiroot, ".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %v", path, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("flock %v: %v", path, err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,77 @@
+//go:build windows
+
+package easyca
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x2
+
+// pkiLock acquires an exclusive LockFileEx lock on the first byte of
+// pkiroot/.lock, playing the role of the Unix flock(2) based implementation.
+// Windows enforces this lock rather than treating it as advisory, which is
+// harmless here since nothing reads or writes .lock. Call the returned unlock
+// func to release it.
+//
+// LockFileEx is invoked directly through syscall.NewLazyDLL rather than
+// golang.org/x/sys/windows, since this tree has no go.mod/vendor directory
+// to pin an external dependency.
+func pkiLock(pkiroot string) (unlock func(), err error) {
+	path := filepath.Join(pkiroot, ".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open %v: %v", path, err)
+	}
+
+	overlapped := new(syscall.Overlapped)
+	handle := syscall.Handle(f.Fd())
+	if err := lockFileEx(handle, lockfileExclusiveLock, 0, 1, 0, overlapped); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lockfileex %v: %v", path, err)
+	}
+
+	return func() {
+		unlockFileEx(handle, 0, 1, 0, overlapped)
+		f.Close()
+	}, nil
+}
+
+func lockFileEx(handle syscall.Handle, flags, reserved, numBytesLo, numBytesHi uint32, overlapped *syscall.Overlapped) error {
+	r, _, err := procLockFileEx.Call(
+		uintptr(handle),
+		uintptr(flags),
+		uintptr(reserved),
+		uintptr(numBytesLo),
+		uintptr(numBytesHi),
+		uintptr(unsafe.Pointer(overlapped)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFileEx(handle syscall.Handle, reserved, numBytesLo, numBytesHi uint32, overlapped *syscall.Overlapped) error {
+	r, _, err := procUnlockFileEx.Call(
+		uintptr(handle),
+		uintptr(reserved),
+		uintptr(numBytesLo),
+		uintptr(numBytesHi),
+		uintptr(unsafe.Pointer(overlapped)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}